@@ -23,6 +23,17 @@ type Description struct {
 
 	// Iface
 	Iface string
+
+	// When set, every generated callback (On, Entry, Exit, Action,
+	// Condition) takes a leading context.Context argument, and the
+	// machine additionally exposes EventCtx/SetStateCtx variants that
+	// honor ctx.Done() between callback invocations.
+	UseContext bool
+
+	// When set, the generated machine takes a Store at construction and
+	// checkpoints its state to it after every successful transition, so
+	// a long-running process can resume mid-workflow after a crash.
+	Persistence bool
 }
 
 type State struct {
@@ -33,6 +44,32 @@ type State struct {
 	// It's type must be func(event Event, state State) error.
 	On string
 
+	// Name of the superstate this state is nested in, if any. Transitions
+	// not handled by this state are looked up on the parent's transition
+	// table instead of raising an "invalid event" error.
+	Parent string
+
+	// Name of the sub-state to descend into whenever this state is
+	// entered as a transition target. The descend continues recursively
+	// as long as the reached state also declares an Initial sub-state.
+	Initial string
+
+	// Function to execute when this state is entered as part of a
+	// transition, including as an ancestor of the actual target state.
+	// It's type must be func(event Event, state State) error.
+	Entry string
+
+	// Function to execute when this state is exited as part of a
+	// transition, including as an ancestor of the actual source state.
+	// It's type must be func(event Event, state State) error.
+	Exit string
+
+	// Names of events that should be queued rather than treated as an
+	// "invalid event" error while the machine is in this state. Queued
+	// events are automatically re-dispatched once a transition reaches a
+	// state that does not defer them.
+	Defer []string
+
 	// State transitions
 	Transitions []*Transition
 }
@@ -51,12 +88,24 @@ type Transition struct {
 	// Function to execute to check whether a transition should occur or not.
 	// It's type must be func(event Event, state State) (bool, error)
 	Condition string
+
+	// State to transition to if this and every other guarded Transition
+	// declared for the same event on this state evaluate their Condition
+	// to false. Only meaningful on (one of) the transitions sharing an
+	// event; the first non-empty Else among them wins.
+	Else string
+
+	// When set, a matching guard runs Action without changing sm.state or
+	// firing Entry/Exit/On callbacks.
+	Internal bool
 }
 
 func main() {
 	inputFile := flag.String("in", "desc.json", "Path to input file.")
 	outputFile := flag.String("out", "statemachine.go", "Path to output file.")
 	pkg := flag.String("package", "main", "Package name (used in the `package ...` statement).")
+	visualizeFlag := flag.Bool("visualize", false, "Emit a state chart diagram instead of Go code.")
+	format := flag.String("format", "dot", "Diagram format to use with -visualize. One of: dot, plantuml.")
 
 	flag.Parse()
 
@@ -75,7 +124,11 @@ func main() {
 
 	buf := new(bytes.Buffer)
 
-	compile(desc, *pkg, buf)
+	if *visualizeFlag {
+		visualize(desc, *format, buf)
+	} else {
+		compile(desc, *pkg, buf)
+	}
 
 	err = ioutil.WriteFile(*outputFile, buf.Bytes(), 0644)
 
@@ -88,18 +141,511 @@ func writef(buf *bytes.Buffer, fmtstr string, args ...interface{}) {
 	buf.WriteString(fmt.Sprintf(fmtstr, args...))
 }
 
+// ctxArgPrefix returns the leading argument text to splice in front of
+// "event, state" in a callback invocation when the description opts into
+// context-aware callbacks, or the empty string otherwise.
+func ctxArgPrefix(desc *Description) string {
+	if desc.UseContext {
+		return "ctx, "
+	}
+
+	return ""
+}
+
+// writeDoneCheck emits a check of ctx.Done(), returning ctx.Err() if it has
+// fired, immediately before a callback invocation. It is a no-op unless the
+// description opted into context-aware callbacks.
+func writeDoneCheck(buf *bytes.Buffer, indent string, desc *Description) {
+	if !desc.UseContext {
+		return
+	}
+
+	writef(buf, "%sselect {\n", indent)
+	writef(buf, "%s\tcase <-ctx.Done():\n", indent)
+	writef(buf, "%s\t\treturn ctx.Err()\n", indent)
+	writef(buf, "%s\tdefault:\n", indent)
+	writef(buf, "%s}\n", indent)
+}
+
 func camel(str string) string {
 	first := str[0]
 
 	return strings.ToUpper(string(first)) + str[1:]
 }
 
+// detectParentCycle walks the Parent chain starting at name and panics if it
+// encounters a state that does not exist or a cycle back to a state already
+// visited in the chain.
+func detectParentCycle(statesMap map[string]*State, name string) {
+	visited := map[string]bool{name: true}
+	cur := name
+
+	for {
+		parent := statesMap[cur].Parent
+
+		if parent == "" {
+			return
+		}
+
+		if statesMap[parent] == nil {
+			panic(fmt.Sprintf("Parent state `%s` of state `%s` does not exist.", parent, cur))
+		}
+
+		if visited[parent] {
+			panic(fmt.Sprintf("Cyclic parent chain detected: state `%s` is its own ancestor.", parent))
+		}
+
+		visited[parent] = true
+		cur = parent
+	}
+}
+
+// detectInitialCycle walks the Initial chain starting at name and panics if
+// it encounters a state that is not a direct child of its declaring parent,
+// or a duplicate/cyclic initial transition.
+func detectInitialCycle(statesMap map[string]*State, name string) {
+	visited := map[string]bool{name: true}
+	cur := name
+
+	for {
+		st := statesMap[cur]
+
+		if st.Initial == "" {
+			return
+		}
+
+		next := statesMap[st.Initial]
+
+		if next == nil {
+			panic(fmt.Sprintf("Initial state `%s` declared on state `%s` does not exist.", st.Initial, cur))
+		}
+
+		if next.Parent != cur {
+			panic(fmt.Sprintf("Initial state `%s` declared on state `%s` must be a direct child of it.", st.Initial, cur))
+		}
+
+		if visited[st.Initial] {
+			panic(fmt.Sprintf("Duplicate/cyclic initial transition detected: state `%s` is reached twice while descending initial states from `%s`.", st.Initial, name))
+		}
+
+		visited[st.Initial] = true
+		cur = st.Initial
+	}
+}
+
+// validateDescription checks desc for duplicate states, a missing Init
+// state, and cyclic Parent/Initial chains, panicking on the first problem
+// found. It returns the state name -> *State lookup built along the way, so
+// both compile and visualize validate the same way and share the result
+// instead of drifting.
+func validateDescription(desc *Description) map[string]*State {
+	statesMap := make(map[string]*State)
+
+	for _, state := range desc.States {
+		if statesMap[state.Name] != nil {
+			panic(fmt.Sprintf("Duplicate state: %s", state.Name))
+		}
+
+		statesMap[state.Name] = state
+	}
+
+	if statesMap[desc.Init] == nil {
+		panic(fmt.Sprintf("Init state `%s` does not exist.", desc.Init))
+	}
+
+	for _, state := range statesMap {
+		detectParentCycle(statesMap, state.Name)
+		detectInitialCycle(statesMap, state.Name)
+	}
+
+	return statesMap
+}
+
+// pathToRoot returns the chain of states from the outermost ancestor down to
+// name (inclusive), following Parent links.
+func pathToRoot(statesMap map[string]*State, name string) []string {
+	var path []string
+
+	for name != "" {
+		path = append([]string{name}, path...)
+		name = statesMap[name].Parent
+	}
+
+	return path
+}
+
+// lcaIndex returns the index, within both a and b, of the least common
+// ancestor of the two state paths, or -1 if they share no common ancestor.
+func lcaIndex(a, b []string) int {
+	i := 0
+
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i - 1
+}
+
+// transitionChains computes the Exit callbacks to run (innermost state
+// first), the Entry callbacks to run (outermost state first, descending
+// through any Initial sub-states of the target) and the actual state the
+// machine ends up in once a transition from "from" to "to" is taken.
+func transitionChains(statesMap map[string]*State, from, to string) (exits []string, entries []string, final string) {
+	pa := pathToRoot(statesMap, from)
+	pb := pathToRoot(statesMap, to)
+
+	l := lcaIndex(pa, pb)
+
+	if from == to {
+		// An external self-transition always fully exits and re-enters.
+		l = -1
+	}
+
+	for i := len(pa) - 1; i > l; i-- {
+		exits = append(exits, pa[i])
+	}
+
+	for i := l + 1; i < len(pb); i++ {
+		entries = append(entries, pb[i])
+	}
+
+	final = to
+
+	for statesMap[final].Initial != "" {
+		final = statesMap[final].Initial
+		entries = append(entries, final)
+	}
+
+	return exits, entries, final
+}
+
+// transitionGroup holds every Transition a state declares for one event, in
+// declared order, so the generated code can try their guards in sequence.
+type transitionGroup struct {
+	Event       string
+	Transitions []*Transition
+}
+
+// effectiveTransitionGroups returns, per event, every Transition that
+// applies to state "name", merging in the transitions declared on its
+// ancestors for any event it does not itself handle. All transitions for an
+// event declared on the closest state always take precedence as a whole
+// group over a superstate's transitions for that same event, which is what
+// lets events "bubble up" a parent's transition table.
+func effectiveTransitionGroups(statesMap map[string]*State, name string) []*transitionGroup {
+	seen := make(map[string]bool)
+	var order []string
+	byEvent := make(map[string][]*Transition)
+
+	for cur := name; cur != ""; cur = statesMap[cur].Parent {
+		for _, transition := range statesMap[cur].Transitions {
+			if seen[transition.Event] {
+				continue
+			}
+
+			if _, ok := byEvent[transition.Event]; !ok {
+				order = append(order, transition.Event)
+			}
+
+			byEvent[transition.Event] = append(byEvent[transition.Event], transition)
+		}
+
+		for _, transition := range statesMap[cur].Transitions {
+			seen[transition.Event] = true
+		}
+	}
+
+	result := make([]*transitionGroup, 0, len(order))
+
+	for _, event := range order {
+		result = append(result, &transitionGroup{Event: event, Transitions: byEvent[event]})
+	}
+
+	return result
+}
+
+// emitTransitionBody emits the effect of actually taking transition from
+// state: its Exit chain, Action, state change, target On, Entry chain and
+// persistence checkpoint. If transition.Internal is set, only Action runs
+// and the state is left untouched, per UML internal-transition semantics.
+func emitTransitionBody(buf *bytes.Buffer, desc *Description, statesMap map[string]*State, state *State, transition *Transition, indent string) {
+	ifaceStr := ""
+
+	if desc.Iface != "" {
+		ifaceStr = "sm.iface."
+	}
+
+	if transition.Internal {
+		if transition.Action != "" {
+			writeDoneCheck(buf, indent, desc)
+			writef(buf, "%sif err := %s%s(%sevent, sm.state); err != nil {\n", indent, ifaceStr, transition.Action, ctxArgPrefix(desc))
+			writef(buf, "%s\treturn err\n", indent)
+			writef(buf, "%s}\n", indent)
+		}
+
+		return
+	}
+
+	var exits, entries []string
+	var final string
+
+	if transition.To != "" {
+		exits, entries, final = transitionChains(statesMap, state.Name, transition.To)
+
+		for _, exitState := range exits {
+			if statesMap[exitState].Exit == "" {
+				continue
+			}
+
+			writeDoneCheck(buf, indent, desc)
+			writef(buf, "%sif err := %s%s(%sevent, sm.state); err != nil {\n", indent, ifaceStr, statesMap[exitState].Exit, ctxArgPrefix(desc))
+			writef(buf, "%s\treturn err\n", indent)
+			writef(buf, "%s}\n", indent)
+		}
+	}
+
+	if transition.Action != "" {
+		writeDoneCheck(buf, indent, desc)
+		writef(buf, "%sif err := %s%s(%sevent, sm.state); err != nil {\n", indent, ifaceStr, transition.Action, ctxArgPrefix(desc))
+		writef(buf, "%s\treturn err\n", indent)
+		writef(buf, "%s}\n", indent)
+	}
+
+	if transition.To == "" {
+		return
+	}
+
+	targetState := statesMap[transition.To]
+
+	if targetState == nil {
+		panic(fmt.Sprintf("Target state in transition from state `%s` to `%s` on event `%s` does not exist.",
+			state.Name, transition.To, transition.Event))
+	}
+
+	writef(buf, "%ssm.state = %q\n", indent, final)
+	writef(buf, "%ssm.epoch++\n", indent)
+
+	if targetState.On != "" {
+		writeDoneCheck(buf, indent, desc)
+		writef(buf, "%sif err := %s%s(%sevent, sm.state); err != nil {\n", indent, ifaceStr, targetState.On, ctxArgPrefix(desc))
+		writef(buf, "%s\treturn err\n", indent)
+		writef(buf, "%s}\n", indent)
+	}
+
+	// Entry callbacks for every ancestor and descendant state crossed on
+	// the way into the (possibly descended) target.
+	for _, entryState := range entries {
+		if statesMap[entryState].Entry == "" {
+			continue
+		}
+
+		writeDoneCheck(buf, indent, desc)
+		writef(buf, "%sif err := %s%s(%sevent, sm.state); err != nil {\n", indent, ifaceStr, statesMap[entryState].Entry, ctxArgPrefix(desc))
+		writef(buf, "%s\treturn err\n", indent)
+		writef(buf, "%s}\n", indent)
+	}
+
+	if desc.Persistence {
+		ctxExpr := "context.Background()"
+
+		if desc.UseContext {
+			ctxExpr = "ctx"
+		}
+
+		writef(buf, "%sif err := sm.store.SaveState(%s, %q, sm.state, event); err != nil {\n", indent, ctxExpr, state.Name)
+		writef(buf, "%s\tsm.state = %q\n", indent, state.Name)
+		writef(buf, "%s\tsm.epoch++\n", indent)
+		writef(buf, "%s\treturn err\n", indent)
+		writef(buf, "%s}\n", indent)
+	}
+}
+
+// emitGuardChain emits the code that, for a single event, tries every
+// Transition declared for it in order and takes the first whose Condition
+// evaluates true. A Transition with no Condition always matches and ends
+// the chain. If none match, it falls back to the first Else target declared
+// among them, or does nothing if none of them declared one.
+func emitGuardChain(buf *bytes.Buffer, desc *Description, statesMap map[string]*State, state *State, group *transitionGroup, indent string) {
+	elseTarget := ""
+
+	for _, transition := range group.Transitions {
+		if transition.Else != "" {
+			elseTarget = transition.Else
+			break
+		}
+	}
+
+	emitGuardStep(buf, desc, statesMap, state, group, 0, elseTarget, indent)
+}
+
+func emitGuardStep(buf *bytes.Buffer, desc *Description, statesMap map[string]*State, state *State, group *transitionGroup, i int, elseTarget string, indent string) {
+	if i == len(group.Transitions) {
+		if elseTarget != "" {
+			emitTransitionBody(buf, desc, statesMap, state, &Transition{Event: group.Event, To: elseTarget}, indent)
+		}
+
+		return
+	}
+
+	transition := group.Transitions[i]
+
+	if transition.Condition == "" {
+		emitTransitionBody(buf, desc, statesMap, state, transition, indent)
+		return
+	}
+
+	ifaceStr := ""
+
+	if desc.Iface != "" {
+		ifaceStr = "sm.iface."
+	}
+
+	writeDoneCheck(buf, indent, desc)
+	writef(buf, "%sif ok, err := %s%s(%sevent, sm.state); err != nil {\n", indent, ifaceStr, transition.Condition, ctxArgPrefix(desc))
+	writef(buf, "%s\treturn err\n", indent)
+	writef(buf, "%s} else if ok {\n", indent)
+	emitTransitionBody(buf, desc, statesMap, state, transition, indent+"\t")
+	writef(buf, "%s} else {\n", indent)
+	emitGuardStep(buf, desc, statesMap, state, group, i+1, elseTarget, indent+"\t")
+	writef(buf, "%s}\n", indent)
+}
+
+// nodeLabel builds the label shown inside a state's node in a diagram,
+// including any On/Entry/Exit callbacks registered on it.
+func nodeLabel(state *State) string {
+	label := state.Name
+
+	if state.On != "" {
+		label += fmt.Sprintf("\non: %s", state.On)
+	}
+
+	if state.Entry != "" {
+		label += fmt.Sprintf("\nentry: %s", state.Entry)
+	}
+
+	if state.Exit != "" {
+		label += fmt.Sprintf("\nexit: %s", state.Exit)
+	}
+
+	return label
+}
+
+// edgeLabel builds the label shown on a transition's edge in a diagram, in
+// the form "event [condition] / action".
+func edgeLabel(transition *Transition) string {
+	label := transition.Event
+
+	if transition.Condition != "" {
+		label += fmt.Sprintf(" [%s]", transition.Condition)
+	}
+
+	if transition.Action != "" {
+		label += fmt.Sprintf(" / %s", transition.Action)
+	}
+
+	return label
+}
+
+// plantUMLID turns a state name into an identifier PlantUML can use as a
+// state alias, since state names may contain characters PlantUML rejects.
+func plantUMLID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+// visualize emits a diagram of the state machine described by desc, in the
+// given format ("dot" or "plantuml"), instead of generating Go code. This
+// lets users review a state chart with `dot`/PlantUML before committing to
+// a description.
+func visualize(desc *Description, format string, buf *bytes.Buffer) {
+	statesMap := validateDescription(desc)
+
+	switch format {
+	case "", "dot":
+		visualizeDot(desc, statesMap, buf)
+	case "plantuml":
+		visualizePlantUML(desc, statesMap, buf)
+	default:
+		panic(fmt.Sprintf("Unknown visualization format: %s", format))
+	}
+}
+
+func visualizeDot(desc *Description, statesMap map[string]*State, buf *bytes.Buffer) {
+	writef(buf, "digraph %s {\n", desc.Name)
+	writef(buf, "\trankdir=LR;\n")
+
+	for _, state := range desc.States {
+		shape := "circle"
+
+		if state.Name == desc.Init {
+			shape = "doublecircle"
+		}
+
+		writef(buf, "\t%q [shape=%s, label=%q];\n", state.Name, shape, nodeLabel(state))
+	}
+
+	for _, state := range desc.States {
+		for _, group := range effectiveTransitionGroups(statesMap, state.Name) {
+			for _, transition := range group.Transitions {
+				if transition.To == "" {
+					continue
+				}
+
+				writef(buf, "\t%q -> %q [label=%q];\n", state.Name, transition.To, edgeLabel(transition))
+			}
+		}
+	}
+
+	writef(buf, "}\n")
+}
+
+func visualizePlantUML(desc *Description, statesMap map[string]*State, buf *bytes.Buffer) {
+	writef(buf, "@startuml\n")
+
+	for _, state := range desc.States {
+		writef(buf, "state %q as %s\n", nodeLabel(state), plantUMLID(state.Name))
+	}
+
+	writef(buf, "[*] --> %s\n", plantUMLID(desc.Init))
+
+	for _, state := range desc.States {
+		for _, group := range effectiveTransitionGroups(statesMap, state.Name) {
+			for _, transition := range group.Transitions {
+				if transition.To == "" {
+					continue
+				}
+
+				writef(buf, "%s --> %s : %s\n", plantUMLID(state.Name), plantUMLID(transition.To), edgeLabel(transition))
+			}
+		}
+	}
+
+	writef(buf, "@enduml\n")
+}
+
 func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 	writef(buf, "// Code generated by genstatem; DO NOT EDIT.\n\n")
 	writef(buf, "package %s\n\n", pkg)
 	writef(buf, "import \"fmt\"\n")
 	writef(buf, "import \"errors\"\n")
-	writef(buf, "import \"sync\"\n\n")
+	writef(buf, "import \"sync\"\n")
+
+	if desc.UseContext || desc.Persistence {
+		writef(buf, "import \"context\"\n")
+	}
+
+	if desc.Persistence {
+		writef(buf, "import \"io/ioutil\"\n")
+		writef(buf, "import \"os\"\n")
+		writef(buf, "import \"strings\"\n")
+	}
+
+	writef(buf, "\n")
 	writef(buf, "// An Event is an 'Event' that can occur.\n")
 	writef(buf, "type Event string\n\n")
 	writef(buf, "// A State is a 'State' a state machine can be in.\n")
@@ -108,11 +654,38 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 	writef(buf, "type %s struct {\n", desc.Name)
 	writef(buf, "\tstate State\n")
 	writef(buf, "\tmu *sync.RWMutex\n")
+	writef(buf, "\tqmu sync.Mutex\n")
+	writef(buf, "\tfiring bool\n")
+	writef(buf, "\tqueue []queuedEvent\n")
+	writef(buf, "\tepoch uint64\n")
 
 	if desc.Iface != "" {
 		writef(buf, "\tiface %s\n", desc.Iface)
 	}
 
+	if desc.Persistence {
+		writef(buf, "\tstore Store\n")
+	}
+
+	writef(buf, "}\n\n")
+
+	writef(buf, "// queuedEvent is an Event that arrived while a dispatch was already in\n")
+	writef(buf, "// progress. deferred and epoch are only meaningful for events queued by a\n")
+	writef(buf, "// state's Defer list: such an event isn't retried until sm.epoch has moved\n")
+	writef(buf, "// past the epoch it was deferred at, i.e. until an actual transition has\n")
+	writef(buf, "// happened since.\n")
+	writef(buf, "type queuedEvent struct {\n")
+	writef(buf, "\tevent Event\n")
+
+	if desc.UseContext {
+		writef(buf, "\t// ctx is the context the call that raised this event was made with,\n")
+		writef(buf, "\t// so a replayed event honors its own caller's cancellation instead\n")
+		writef(buf, "\t// of whichever context happened to be dispatching at the time.\n")
+		writef(buf, "\tctx context.Context\n")
+	}
+
+	writef(buf, "\tdeferred bool\n")
+	writef(buf, "\tepoch uint64\n")
 	writef(buf, "}\n\n")
 
 	writef(buf, "// State returns the state the state machine is in.\n")
@@ -121,37 +694,80 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 	writef(buf, "\tdefer sm.mu.RUnlock()\n\n")
 	writef(buf, "\treturn sm.state\n}\n\n")
 
-	statesMap := make(map[string]*State)
-	eventsMap := make(map[string]bool)
-
-	for _, state := range desc.States {
-		it := statesMap[state.Name]
+	if desc.Persistence {
+		writef(buf, "// ErrStoreNotFound should be returned by Store.LoadState when no\n")
+		writef(buf, "// checkpoint exists yet, so New%s can fall back to the description's\n", desc.Name)
+		writef(buf, "// initial state instead of treating it as a load failure.\n")
+		writef(buf, "var ErrStoreNotFound = errors.New(\"genstatem: no checkpoint found\")\n\n")
+
+		writef(buf, "// Store is a pluggable persistence backend for %s. SaveState is called\n", desc.Name)
+		writef(buf, "// while the machine's lock is held, after every successful transition,\n")
+		writef(buf, "// so the in-memory state and the durable checkpoint never diverge.\n")
+		writef(buf, "type Store interface {\n")
+		writef(buf, "\tLoadState(ctx context.Context) (State, error)\n")
+		writef(buf, "\tSaveState(ctx context.Context, from State, to State, event Event) error\n")
+		writef(buf, "}\n\n")
 
-		if it != nil {
-			panic(fmt.Sprintf("Duplicate state: %s", state.Name))
-		}
+		writef(buf, "// MemoryStore is an in-memory Store. It does not survive process\n")
+		writef(buf, "// restarts; use it for testing or machines that don't need to resume.\n")
+		writef(buf, "type MemoryStore struct {\n")
+		writef(buf, "\tmu    sync.Mutex\n")
+		writef(buf, "\tstate State\n")
+		writef(buf, "\tknown bool\n")
+		writef(buf, "}\n\n")
+		writef(buf, "func (s *MemoryStore) LoadState(ctx context.Context) (State, error) {\n")
+		writef(buf, "\ts.mu.Lock()\n")
+		writef(buf, "\tdefer s.mu.Unlock()\n\n")
+		writef(buf, "\tif !s.known {\n")
+		writef(buf, "\t\treturn \"\", ErrStoreNotFound\n")
+		writef(buf, "\t}\n\n")
+		writef(buf, "\treturn s.state, nil\n")
+		writef(buf, "}\n\n")
+		writef(buf, "func (s *MemoryStore) SaveState(ctx context.Context, from State, to State, event Event) error {\n")
+		writef(buf, "\ts.mu.Lock()\n")
+		writef(buf, "\tdefer s.mu.Unlock()\n\n")
+		writef(buf, "\ts.state = to\n")
+		writef(buf, "\ts.known = true\n")
+		writef(buf, "\treturn nil\n")
+		writef(buf, "}\n\n")
 
-		statesMap[state.Name] = state
+		writef(buf, "// FileStore is a Store that checkpoints the state to a single file on\n")
+		writef(buf, "// disk via a write-then-rename, so a crash never leaves a partial\n")
+		writef(buf, "// checkpoint behind and a restarted process can resume mid-workflow.\n")
+		writef(buf, "type FileStore struct {\n")
+		writef(buf, "\tPath string\n")
+		writef(buf, "}\n\n")
+		writef(buf, "func (s *FileStore) LoadState(ctx context.Context) (State, error) {\n")
+		writef(buf, "\tdata, err := ioutil.ReadFile(s.Path)\n\n")
+		writef(buf, "\tif err != nil {\n")
+		writef(buf, "\t\tif os.IsNotExist(err) {\n")
+		writef(buf, "\t\t\treturn \"\", ErrStoreNotFound\n")
+		writef(buf, "\t\t}\n\n")
+		writef(buf, "\t\treturn \"\", err\n")
+		writef(buf, "\t}\n\n")
+		writef(buf, "\treturn State(strings.TrimSpace(string(data))), nil\n")
+		writef(buf, "}\n\n")
+		writef(buf, "func (s *FileStore) SaveState(ctx context.Context, from State, to State, event Event) error {\n")
+		writef(buf, "\ttmp := s.Path + \".tmp\"\n\n")
+		writef(buf, "\tif err := ioutil.WriteFile(tmp, []byte(string(to)), 0644); err != nil {\n")
+		writef(buf, "\t\treturn err\n")
+		writef(buf, "\t}\n\n")
+		writef(buf, "\treturn os.Rename(tmp, s.Path)\n")
+		writef(buf, "}\n\n")
+	}
 
-		transitionMap := make(map[string]bool)
+	statesMap := validateDescription(desc)
+	eventsMap := make(map[string]bool)
 
+	for _, state := range desc.States {
+		// A state may declare more than one Transition for the same event,
+		// each guarded by its own Condition; the generated code tries them
+		// in declared order at run time, so no uniqueness check is needed here.
 		for _, transition := range state.Transitions {
-			it := transitionMap[transition.Event]
-
-			if it {
-				panic(fmt.Sprintf("Can't have two transitions for the same event. Duplicate event: %s.", transition.Event))
-			}
-
-			transitionMap[transition.Event] = true
-
 			eventsMap[transition.Event] = true
 		}
 	}
 
-	if statesMap[desc.Init] == nil {
-		panic(fmt.Sprintf("Init state `%s` does not exist.", desc.Init))
-	}
-
 	if desc.Iface != "" {
 		writef(buf, "// SetIface sets the internal state of the state machine.\n")
 		writef(buf, "func (sm *%s) SetIface(iface %s) {\n", desc.Name, desc.Iface)
@@ -161,13 +777,27 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 		writef(buf, "}\n\n")
 	}
 
-	writef(buf, "// SetState sets the state of the state machine. If invokeOn\n")
+	setStateMethod := "SetState"
+	setStateSig := "func (sm *%s) SetState(state State, event Event, invokeOn bool) error {\n"
+
+	if desc.UseContext {
+		setStateMethod = "SetStateCtx"
+		setStateSig = "func (sm *%s) SetStateCtx(ctx context.Context, state State, event Event, invokeOn bool) error {\n"
+	}
+
+	writef(buf, "// %s sets the state of the state machine. If invokeOn\n", setStateMethod)
 	writef(buf, "// is true then it'll also invoke the 'on' function for that state.\n")
 	writef(buf, "// The parameter event is passed as the event parameter to the 'on' function.\n")
-	writef(buf, "func (sm *%s) SetState(state State, event Event, invokeOn bool) error {\n", desc.Name)
+	writef(buf, setStateSig, desc.Name)
 	writef(buf, "\tsm.mu.Lock()\n")
 	writef(buf, "\tdefer sm.mu.Unlock()\n")
+
+	if desc.Persistence {
+		writef(buf, "\tprevState := sm.state\n")
+	}
+
 	writef(buf, "\tsm.state = state\n")
+	writef(buf, "\tsm.epoch++\n")
 	writef(buf, "\tif invokeOn {\n")
 	writef(buf, "\t\tswitch state {\n")
 
@@ -181,7 +811,8 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 				ifaceStr = "sm.iface."
 			}
 
-			writef(buf, "\t\t\tif err := %s%s(event, sm.state); err != nil {\n", ifaceStr, state.On)
+			writeDoneCheck(buf, "\t\t\t", desc)
+			writef(buf, "\t\t\tif err := %s%s(%sevent, sm.state); err != nil {\n", ifaceStr, state.On, ctxArgPrefix(desc))
 			writef(buf, "\t\t\t\treturn err\n")
 			writef(buf, "\t\t\t}\n")
 		}
@@ -190,9 +821,32 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 	writef(buf, "\t\t}\n")
 
 	writef(buf, "\t}\n\n")
+
+	if desc.Persistence {
+		ctxExpr := "context.Background()"
+
+		if desc.UseContext {
+			ctxExpr = "ctx"
+		}
+
+		writef(buf, "\tif err := sm.store.SaveState(%s, prevState, sm.state, event); err != nil {\n", ctxExpr)
+		writef(buf, "\t\tsm.state = prevState\n")
+		writef(buf, "\t\tsm.epoch++\n")
+		writef(buf, "\t\treturn err\n")
+		writef(buf, "\t}\n\n")
+	}
+
 	writef(buf, "\treturn nil\n")
 	writef(buf, "}\n\n")
 
+	if desc.UseContext {
+		writef(buf, "// SetState sets the state of the state machine using a background\n")
+		writef(buf, "// context. See SetStateCtx.\n")
+		writef(buf, "func (sm *%s) SetState(state State, event Event, invokeOn bool) error {\n", desc.Name)
+		writef(buf, "\treturn sm.SetStateCtx(context.Background(), state, event, invokeOn)\n")
+		writef(buf, "}\n\n")
+	}
+
 	for _, state := range statesMap {
 		writef(buf, "const State%s = %q\n", camel(state.Name), state.Name)
 	}
@@ -207,7 +861,83 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 	writef(buf, "// Event informs the state machine about an occured 'Event'. The state\n")
 	writef(buf, "// machine will then transition into the correct target state and invoke the\n")
 	writef(buf, "// registered callbacks.\n")
-	writef(buf, "func (sm *%s) Event(event Event) error {\n", desc.Name)
+	writef(buf, "//\n")
+	writef(buf, "// Callbacks (Action, On, Condition, Entry, Exit) may safely call Event\n")
+	writef(buf, "// again: the outermost call drains a FIFO queue of events, while any call\n")
+	writef(buf, "// made while a dispatch is already in progress is queued and returns nil\n")
+	writef(buf, "// immediately instead of deadlocking. An event deferred by the current\n")
+	writef(buf, "// state's Defer list is left at the front of the queue until a later\n")
+	writef(buf, "// transition actually changes the state, instead of being retried\n")
+	writef(buf, "// immediately against the same state.\n")
+	eventSig := "func (sm *%s) Event(event Event) error {\n"
+	fireSig := "func (sm *%s) fire(event Event) error {\n"
+	fireCall := "sm.fire(event)"
+	fireCallNext := "sm.fire(next.event)"
+	enqueueEntry := "queuedEvent{event: event}"
+
+	if desc.UseContext {
+		eventSig = "func (sm *%s) EventCtx(ctx context.Context, event Event) error {\n"
+		fireSig = "func (sm *%s) fire(ctx context.Context, event Event) error {\n"
+		fireCall = "sm.fire(ctx, event)"
+		fireCallNext = "sm.fire(next.ctx, next.event)"
+		enqueueEntry = "queuedEvent{event: event, ctx: ctx}"
+	}
+
+	writef(buf, eventSig, desc.Name)
+	writef(buf, "\tsm.qmu.Lock()\n")
+	writef(buf, "\tif sm.firing {\n")
+	writef(buf, "\t\tsm.queue = append(sm.queue, %s)\n", enqueueEntry)
+	writef(buf, "\t\tsm.qmu.Unlock()\n")
+	writef(buf, "\t\treturn nil\n")
+	writef(buf, "\t}\n")
+	writef(buf, "\tsm.firing = true\n")
+	writef(buf, "\tsm.qmu.Unlock()\n\n")
+	writef(buf, "\terr := %s\n\n", fireCall)
+	writef(buf, "\t// epoch is read under sm.mu, the same lock every writer (fire,\n")
+	writef(buf, "\t// SetState/SetStateCtx) holds while bumping it, rather than under\n")
+	writef(buf, "\t// sm.qmu, so a concurrent SetState can't race with this read.\n")
+	writef(buf, "\tsm.mu.RLock()\n")
+	writef(buf, "\tepoch := sm.epoch\n")
+	writef(buf, "\tsm.mu.RUnlock()\n\n")
+	writef(buf, "\tfor {\n")
+	writef(buf, "\t\tsm.qmu.Lock()\n")
+	writef(buf, "\t\tif err != nil || len(sm.queue) == 0 {\n")
+	writef(buf, "\t\t\tsm.firing = false\n")
+	writef(buf, "\t\t\tsm.qmu.Unlock()\n")
+	writef(buf, "\t\t\tbreak\n")
+	writef(buf, "\t\t}\n")
+	writef(buf, "\t\tnext := sm.queue[0]\n")
+	writef(buf, "\t\tif next.deferred && next.epoch == epoch {\n")
+	writef(buf, "\t\t\t// Still deferred: no transition has happened since this event\n")
+	writef(buf, "\t\t\t// was queued, so retrying now would just re-defer it forever.\n")
+	writef(buf, "\t\t\t// Leave it at the front of the queue and stop draining; it'll\n")
+	writef(buf, "\t\t\t// be picked up again the next time Event/fire runs.\n")
+	writef(buf, "\t\t\tsm.firing = false\n")
+	writef(buf, "\t\t\tsm.qmu.Unlock()\n")
+	writef(buf, "\t\t\tbreak\n")
+	writef(buf, "\t\t}\n")
+	writef(buf, "\t\tsm.queue = sm.queue[1:]\n")
+	writef(buf, "\t\tsm.qmu.Unlock()\n")
+	writef(buf, "\t\terr = %s\n", fireCallNext)
+	writef(buf, "\t\tsm.mu.RLock()\n")
+	writef(buf, "\t\tepoch = sm.epoch\n")
+	writef(buf, "\t\tsm.mu.RUnlock()\n")
+	writef(buf, "\t}\n\n")
+	writef(buf, "\treturn err\n")
+	writef(buf, "}\n\n")
+
+	if desc.UseContext {
+		writef(buf, "// Event informs the state machine about an occured 'Event' using a\n")
+		writef(buf, "// background context. See EventCtx.\n")
+		writef(buf, "func (sm *%s) Event(event Event) error {\n", desc.Name)
+		writef(buf, "\treturn sm.EventCtx(context.Background(), event)\n")
+		writef(buf, "}\n\n")
+	}
+
+	writef(buf, "// fire dispatches a single event against the current state while holding\n")
+	writef(buf, "// sm.mu. It is only ever called by Event, which serializes dispatches so\n")
+	writef(buf, "// fire itself never needs to re-acquire sm.mu or sm.qmu re-entrantly.\n")
+	writef(buf, fireSig, desc.Name)
 	writef(buf, "\tsm.mu.Lock()\n")
 	writef(buf, "\tdefer sm.mu.Unlock()\n\n")
 	writef(buf, "\tswitch sm.state {\n")
@@ -217,63 +947,36 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 
 		writef(buf, "\t\tswitch event {\n")
 
-		for _, transition := range state.Transitions {
-			writef(buf, "\t\tcase %q:\n", transition.Event)
-
-			if transition.Condition != "" {
-				ifaceStr := ""
+		groups := effectiveTransitionGroups(statesMap, state.Name)
+		handled := make(map[string]bool)
 
-				if desc.Iface != "" {
-					ifaceStr = "sm.iface."
-				}
+		for _, group := range groups {
+			handled[group.Event] = true
+		}
 
-				writef(buf, "\t\t\tif ok, err := %s%s(event, sm.state); true {\n", ifaceStr, transition.Condition)
-				writef(buf, "\t\t\tif err != nil { return err }\n")
-				writef(buf, "\t\t\tif ok{\n")
+		for _, deferredEvent := range state.Defer {
+			if handled[deferredEvent] {
+				continue
 			}
 
-			if transition.Action != "" {
-				ifaceStr := ""
+			handled[deferredEvent] = true
 
-				if desc.Iface != "" {
-					ifaceStr = "sm.iface."
-				}
+			deferEntry := "queuedEvent{event: event, deferred: true, epoch: sm.epoch}"
 
-				writef(buf, "\t\t\tif err := %s%s(event, sm.state); err != nil {\n", ifaceStr, transition.Action)
-				writef(buf, "\t\t\t\treturn err\n")
-				writef(buf, "\t\t\t}\n")
+			if desc.UseContext {
+				deferEntry = "queuedEvent{event: event, ctx: ctx, deferred: true, epoch: sm.epoch}"
 			}
 
-			// but only if there's a target state defined
-			if transition.To != "" {
-				// is there a condition registered?
-
-				targetState := statesMap[transition.To]
-
-				if targetState == nil {
-					panic(fmt.Sprintf("Target state in transition from state `%s` to `%s` on event `%s` does not exist.",
-						state.Name, transition.To, transition.Event))
-				}
-
-				writef(buf, "\t\t\tsm.state = %q\n", transition.To)
-
-				// Does the target state have an on?
-				if targetState.On != "" {
-					ifaceStr := ""
-
-					if desc.Iface != "" {
-						ifaceStr = "sm.iface."
-					}
-
-					writef(buf, "\t\t\tif err := %s%s(event, sm.state); err != nil {\n", ifaceStr, targetState.On)
-					writef(buf, "\t\t\t\treturn err\n")
-					writef(buf, "\t\t\t}\n")
-				}
-			}
+			writef(buf, "\t\tcase %q:\n", deferredEvent)
+			writef(buf, "\t\t\tsm.qmu.Lock()\n")
+			writef(buf, "\t\t\tsm.queue = append(sm.queue, %s)\n", deferEntry)
+			writef(buf, "\t\t\tsm.qmu.Unlock()\n")
+			writef(buf, "\t\t\treturn nil\n")
+		}
 
-			if transition.Condition != "" {
-				writef(buf, "\t\t\t}}\n")
-			}
+		for _, group := range groups {
+			writef(buf, "\t\tcase %q:\n", group.Event)
+			emitGuardChain(buf, desc, statesMap, state, group, "\t\t\t")
 		}
 
 		writef(buf, "\t\tdefault:\n")
@@ -286,15 +989,44 @@ func compile(desc *Description, pkg string, buf *bytes.Buffer) {
 	writef(buf, "\treturn nil\n")
 	writef(buf, "}\n\n")
 
-	if desc.Iface == "" {
-		writef(buf, "// New%s() creates a new state machine.\n", desc.Name)
-		writef(buf, "func New%s() *%s{\n", desc.Name, desc.Name)
-		writef(buf, "\treturn &%s{state:%q, mu: &sync.RWMutex{}}\n", desc.Name, desc.Init)
-		writef(buf, "}\n\n")
-	} else {
-		writef(buf, "// New%s creates a new state machine.\n", desc.Name)
-		writef(buf, "func New%s(iface %s) *%s{\n", desc.Name, desc.Iface, desc.Name)
-		writef(buf, "\treturn &%s{state:%q, mu: &sync.RWMutex{}, iface: iface}\n", desc.Name, desc.Init)
-		writef(buf, "}\n\n")
+	if !desc.Persistence {
+		if desc.Iface == "" {
+			writef(buf, "// New%s() creates a new state machine.\n", desc.Name)
+			writef(buf, "func New%s() *%s{\n", desc.Name, desc.Name)
+			writef(buf, "\treturn &%s{state:%q, mu: &sync.RWMutex{}}\n", desc.Name, desc.Init)
+			writef(buf, "}\n\n")
+		} else {
+			writef(buf, "// New%s creates a new state machine.\n", desc.Name)
+			writef(buf, "func New%s(iface %s) *%s{\n", desc.Name, desc.Iface, desc.Name)
+			writef(buf, "\treturn &%s{state:%q, mu: &sync.RWMutex{}, iface: iface}\n", desc.Name, desc.Init)
+			writef(buf, "}\n\n")
+		}
+
+		return
+	}
+
+	ifaceParam := ""
+	ifaceField := ""
+
+	if desc.Iface != "" {
+		ifaceParam = fmt.Sprintf("iface %s, ", desc.Iface)
+		ifaceField = ", iface: iface"
 	}
+
+	writef(buf, "// New%s creates a new state machine, restoring its state from store if\n", desc.Name)
+	writef(buf, "// store.LoadState finds a checkpoint, or falling back to the description's\n")
+	writef(buf, "// initial state if it returns ErrStoreNotFound.\n")
+	writef(buf, "func New%s(%sstore Store) (*%s, error) {\n", desc.Name, ifaceParam, desc.Name)
+	writef(buf, "\tsm := &%s{mu: &sync.RWMutex{}, store: store%s}\n\n", desc.Name, ifaceField)
+	writef(buf, "\tstate, err := store.LoadState(context.Background())\n\n")
+	writef(buf, "\tif err != nil {\n")
+	writef(buf, "\t\tif err == ErrStoreNotFound {\n")
+	writef(buf, "\t\t\tsm.state = %q\n", desc.Init)
+	writef(buf, "\t\t\treturn sm, nil\n")
+	writef(buf, "\t\t}\n\n")
+	writef(buf, "\t\treturn nil, err\n")
+	writef(buf, "\t}\n\n")
+	writef(buf, "\tsm.state = state\n")
+	writef(buf, "\treturn sm, nil\n")
+	writef(buf, "}\n\n")
 }
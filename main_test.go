@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// --- unit tests for the generator's internal bookkeeping ---
+
+func TestValidateDescriptionDetectsDuplicateState(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate state")
+		}
+	}()
+
+	validateDescription(&Description{
+		Init:   "a",
+		States: []*State{{Name: "a"}, {Name: "a"}},
+	})
+}
+
+func TestValidateDescriptionDetectsMissingInit(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on missing Init state")
+		}
+	}()
+
+	validateDescription(&Description{
+		Init:   "missing",
+		States: []*State{{Name: "a"}},
+	})
+}
+
+func TestValidateDescriptionDetectsParentCycle(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on cyclic Parent chain")
+		}
+	}()
+
+	validateDescription(&Description{
+		Init:   "a",
+		States: []*State{{Name: "a", Parent: "b"}, {Name: "b", Parent: "a"}},
+	})
+}
+
+func TestEffectiveTransitionGroupsBubblesFromParent(t *testing.T) {
+	statesMap := map[string]*State{
+		"parent": {Name: "parent", Transitions: []*Transition{{Event: "go", To: "parent"}}},
+		"child":  {Name: "child", Parent: "parent"},
+	}
+
+	groups := effectiveTransitionGroups(statesMap, "child")
+
+	if len(groups) != 1 || groups[0].Event != "go" {
+		t.Fatalf("expected child to inherit the parent's `go` transition, got %+v", groups)
+	}
+}
+
+func TestEffectiveTransitionGroupsChildOverridesParent(t *testing.T) {
+	statesMap := map[string]*State{
+		"parent": {Name: "parent", Transitions: []*Transition{{Event: "go", To: "parent"}}},
+		"child":  {Name: "child", Parent: "parent", Transitions: []*Transition{{Event: "go", To: "child"}}},
+	}
+
+	groups := effectiveTransitionGroups(statesMap, "child")
+
+	if len(groups) != 1 || len(groups[0].Transitions) != 1 || groups[0].Transitions[0].To != "child" {
+		t.Fatalf("expected child's own `go` transition to shadow the parent's, got %+v", groups)
+	}
+}
+
+// --- behavioral tests: compile a Description, build it, run it ---
+
+// buildAndRun compiles desc to Go source, adds extra (callback stubs plus a
+// main() entry point), builds the result as a standalone GOPATH-style package
+// (this repo ships no go.mod, so the generated code must build without one),
+// and returns its stdout.
+func buildAndRun(t *testing.T, desc *Description, extra string) string {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	compile(desc, "main", buf)
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "statemachine.go"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "driver.go"), []byte(extra), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binPath := filepath.Join(dir, "bin")
+	build := exec.Command("go", "build", "-o", binPath, ".")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GO111MODULE=off")
+
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v\n%s", err, out)
+	}
+
+	run := exec.Command(binPath)
+	out, err := run.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("generated binary failed: %v\n%s", err, out)
+	}
+
+	return string(out)
+}
+
+func TestHierarchicalEntryCascade(t *testing.T) {
+	desc := &Description{
+		Name: "Door",
+		Init: "idle",
+		States: []*State{
+			{Name: "playing", Entry: "onEnterPlaying", Exit: "onExitPlaying"},
+			{Name: "playing_paused", Parent: "playing", Entry: "onEnterPaused", Transitions: []*Transition{{Event: "resume", To: "playing"}}},
+			{Name: "idle", Transitions: []*Transition{{Event: "pause", To: "playing_paused"}}},
+		},
+	}
+
+	out := buildAndRun(t, desc, `
+package main
+
+import "fmt"
+
+func onEnterPlaying(event Event, state State) error { fmt.Println("enter playing"); return nil }
+func onExitPlaying(event Event, state State) error  { fmt.Println("exit playing"); return nil }
+func onEnterPaused(event Event, state State) error  { fmt.Println("enter paused"); return nil }
+
+func main() {
+	sm := NewDoor()
+	sm.Event("pause")
+	fmt.Println("state:", sm.State())
+}
+`)
+
+	want := "enter playing\nenter paused\nstate: playing_paused\n"
+
+	if out != want {
+		t.Fatalf("entry cascade mismatch:\ngot:  %q\nwant: %q", out, want)
+	}
+}
+
+func TestDeferredEventRetriesAfterTransition(t *testing.T) {
+	desc := &Description{
+		Name: "Door",
+		Init: "loading",
+		States: []*State{
+			{Name: "loading", Defer: []string{"play"}, Transitions: []*Transition{{Event: "ready", To: "idle"}}},
+			{Name: "idle", Transitions: []*Transition{{Event: "play", To: "playing"}}},
+			{Name: "playing"},
+		},
+	}
+
+	out := buildAndRun(t, desc, `
+package main
+
+import "fmt"
+
+func main() {
+	sm := NewDoor()
+	sm.Event("play")
+	fmt.Println("after play:", sm.State())
+	sm.Event("ready")
+	fmt.Println("after ready:", sm.State())
+}
+`)
+
+	want := "after play: loading\nafter ready: playing\n"
+
+	if out != want {
+		t.Fatalf("deferred event wasn't retried once the state changed:\ngot:  %q\nwant: %q", out, want)
+	}
+}
+
+func TestEventCtxReplaysQueuedEventWithItsOwnContext(t *testing.T) {
+	desc := &Description{
+		Name:       "Door",
+		Init:       "idle",
+		UseContext: true,
+		States: []*State{
+			{Name: "idle", Transitions: []*Transition{{Event: "play", To: "playing", Action: "onPlay"}}},
+			{Name: "playing", Transitions: []*Transition{{Event: "stop", To: "idle", Action: "onStop"}}},
+		},
+	}
+
+	out := buildAndRun(t, desc, `
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var sm *Door
+
+func onPlay(ctx context.Context, event Event, state State) error {
+	nested, cancel := context.WithCancel(context.Background())
+	cancel()
+	sm.EventCtx(nested, "stop")
+	return nil
+}
+
+func onStop(ctx context.Context, event Event, state State) error {
+	fmt.Println("onStop ctx err:", ctx.Err())
+	return nil
+}
+
+func main() {
+	sm = NewDoor()
+	err := sm.EventCtx(context.Background(), "play")
+	fmt.Println("play err:", err)
+}
+`)
+
+	want := "play err: context canceled\n"
+
+	if out != want {
+		t.Fatalf("replayed event did not honor its own caller's context:\ngot:  %q\nwant: %q", out, want)
+	}
+}
+
+func TestGuardChainElseFallback(t *testing.T) {
+	desc := &Description{
+		Name: "Door",
+		Init: "idle",
+		States: []*State{
+			{Name: "idle", Transitions: []*Transition{
+				{Event: "open", To: "fast", Condition: "CanOpenFast"},
+				{Event: "open", To: "slow", Condition: "CanOpenSlow", Else: "jammed"},
+			}},
+			{Name: "fast"}, {Name: "slow"}, {Name: "jammed"},
+		},
+	}
+
+	out := buildAndRun(t, desc, `
+package main
+
+import "fmt"
+
+func CanOpenFast(event Event, state State) (bool, error) { return false, nil }
+func CanOpenSlow(event Event, state State) (bool, error) { return false, nil }
+
+func main() {
+	sm := NewDoor()
+	sm.Event("open")
+	fmt.Println("state:", sm.State())
+}
+`)
+
+	want := "state: jammed\n"
+
+	if out != want {
+		t.Fatalf("no guard matched, expected the Else fallback to fire:\ngot:  %q\nwant: %q", out, want)
+	}
+}
+
+func TestPersistenceRollsBackOnSaveFailure(t *testing.T) {
+	desc := &Description{
+		Name:        "Door",
+		Init:        "idle",
+		Persistence: true,
+		States: []*State{
+			{Name: "idle", Transitions: []*Transition{{Event: "open", To: "open"}}},
+			{Name: "open"},
+		},
+	}
+
+	out := buildAndRun(t, desc, `
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type failingStore struct{}
+
+func (failingStore) LoadState(ctx context.Context) (State, error) { return "", ErrStoreNotFound }
+func (failingStore) SaveState(ctx context.Context, from State, to State, event Event) error {
+	return errors.New("disk full")
+}
+
+func main() {
+	sm, err := NewDoor(failingStore{})
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = sm.Event("open")
+	fmt.Println("event err:", err)
+	fmt.Println("state:", sm.State())
+}
+`)
+
+	want := "event err: disk full\nstate: idle\n"
+
+	if out != want {
+		t.Fatalf("state wasn't rolled back after a failed checkpoint:\ngot:  %q\nwant: %q", out, want)
+	}
+}